@@ -1,33 +1,78 @@
 package provision
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 )
 
 // AWSProvisioner provision a VM on aws
 type AWSProvisioner struct {
-	client *ec2.EC2
+	client ec2iface.EC2API
 }
 
+// hostTagKey is set on every resource created for a host (instance, security
+// group, EBS volumes) so that Delete can find and clean them all up
+// unambiguously, without relying on naming conventions alone.
+const hostTagKey = "inletsctl-host"
+
 type ami struct {
-	ID           string
-	CreationDate time.Time
+	ID             string
+	RootDeviceName string
+	RootVolumeSize int64
+	CreationDate   time.Time
+}
+
+// defaultArchitecture is used when host.Additional["architecture"] is unset
+const defaultArchitecture = "x86_64"
+
+// defaultRootVolumeType is used when host.Additional["root-volume-type"] is unset
+const defaultRootVolumeType = "gp3"
+
+// defaultRootVolumeSize is used when host.Additional["root-volume-size"] is
+// unset and the AMI's own block device mapping doesn't report a size for its
+// root device, so we never send RunInstances a zero-sized volume.
+const defaultRootVolumeSize = 20
+
+// defaultInstanceTypes gives an instance type family appropriate for each
+// supported architecture, used when host.Plan is left unset so that
+// architecture=arm64 doesn't silently fall back to an x86_64 plan.
+var defaultInstanceTypes = map[string]string{
+	"x86_64": "t3.micro",
+	"arm64":  "t4g.micro",
 }
 
+// defaultAllowCIDR is used when host.Additional["allow-cidrs"] is unset, to
+// keep the existing wide-open behaviour by default
+const defaultAllowCIDR = "0.0.0.0/0"
+
 // NewAWSProvisioner with an accessKey and secretKey
 func NewAWSProvisioner(accessKey, secretKey, region string) (*AWSProvisioner, error) {
+	return newAWSProvisioner(accessKey, secretKey, "", region)
+}
+
+// NewAWSProvisionerWithSessionToken is like NewAWSProvisioner but also
+// accepts an STS session token, for callers using temporary credentials.
+func NewAWSProvisionerWithSessionToken(accessKey, secretKey, sessionToken, region string) (*AWSProvisioner, error) {
+	return newAWSProvisioner(accessKey, secretKey, sessionToken, region)
+}
+
+func newAWSProvisioner(accessKey, secretKey, sessionToken, region string) (*AWSProvisioner, error) {
 	sess, err := session.NewSession(&aws.Config{
 		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, sessionToken),
 	})
 
 	if err != nil {
@@ -42,41 +87,140 @@ func NewAWSProvisioner(accessKey, secretKey, region string) (*AWSProvisioner, er
 	}, nil
 }
 
+// NewAWSProvisionerFromChain creates an AWSProvisioner using the AWS default
+// credential provider chain: environment variables, the shared
+// ~/.aws/credentials file, and finally the EC2 instance metadata service via
+// ec2rolecreds. This lets inletsctl run from an EC2 host or CI runner that
+// has an IAM instance profile attached, without embedding static credentials.
+func NewAWSProvisionerFromChain(region string) (*AWSProvisioner, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.SharedCredentialsProvider{},
+		&ec2rolecreds.EC2RoleProvider{
+			Client: ec2metadata.New(sess),
+		},
+	})
+
+	// Create EC2 service client
+	svc := ec2.New(sess, aws.NewConfig().WithCredentials(creds))
+
+	return &AWSProvisioner{
+		client: svc,
+	}, nil
+}
+
 // Provision is creating an instance on the defined region
 // It tries to use the default VPC or re-create it using the CreateDefaultVpc function
+// It blocks until the instance reaches the running state, then describes it
+// once more and returns its public IP as reported at that point (empty if
+// none has been assigned).
 func (p *AWSProvisioner) Provision(host BasicHost) (*ProvisionedHost, error) {
-	ami, err := p.findAMI(host.OS)
+	return p.ProvisionWithContext(context.Background(), host)
+}
+
+// ProvisionWithContext is like Provision but lets callers propagate
+// cancellation and deadlines through to the underlying AWS SDK calls.
+func (p *AWSProvisioner) ProvisionWithContext(ctx context.Context, host BasicHost) (*ProvisionedHost, error) {
+	architecture := host.Additional["architecture"]
+	if architecture == "" {
+		architecture = defaultArchitecture
+	}
+
+	ami, err := p.findAMI(ctx, host.OS, architecture)
 	if err != nil {
 		return nil, err
 	}
 
+	plan := host.Plan
+	if plan == "" {
+		plan = defaultInstanceTypes[architecture]
+	}
+
 	inletsPort, err := strconv.ParseInt(host.Additional["inlets-port"], 10, 64)
 	if err != nil {
 		return nil, err
 	}
 
-	vpcID, err := p.getOrCreateDefaultVPC()
+	vpcID, err := p.getOrCreateDefaultVPC(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	securityGroupID, err := p.createSecurityGroup(vpcID, host.Name, inletsPort)
+	allowCIDRs := []string{defaultAllowCIDR}
+	if host.Additional["allow-cidrs"] != "" {
+		allowCIDRs = strings.Split(host.Additional["allow-cidrs"], ",")
+	}
+
+	openHTTP := host.Additional["open-http"] != "false"
+
+	securityGroupID, err := p.createSecurityGroup(ctx, vpcID, host.Name, inletsPort, allowCIDRs, openHTTP)
 	if err != nil {
 		return nil, err
 	}
 
-	runResult, err := p.client.RunInstances(&ec2.RunInstancesInput{
-		ImageId:          aws.String(ami),
-		InstanceType:     aws.String(host.Plan),
-		MinCount:         aws.Int64(1),
-		MaxCount:         aws.Int64(1),
-		UserData:         aws.String(base64.StdEncoding.EncodeToString([]byte(host.UserData))),
-		SecurityGroupIds: []*string{aws.String(securityGroupID)},
+	rootVolumeSize := ami.RootVolumeSize
+	if rootVolumeSize == 0 {
+		rootVolumeSize = defaultRootVolumeSize
+	}
+	if size, err := strconv.ParseInt(host.Additional["root-volume-size"], 10, 64); err == nil {
+		rootVolumeSize = size
+	}
+
+	rootVolumeType := host.Additional["root-volume-type"]
+	if rootVolumeType == "" {
+		rootVolumeType = defaultRootVolumeType
+	}
+
+	var marketOptions *ec2.InstanceMarketOptionsRequest
+	if host.Additional["spot"] == "true" {
+		spotOptions := &ec2.SpotMarketOptions{}
+		if maxSpotPrice := host.Additional["max-spot-price"]; maxSpotPrice != "" {
+			spotOptions.MaxPrice = aws.String(maxSpotPrice)
+		}
+
+		marketOptions = &ec2.InstanceMarketOptionsRequest{
+			MarketType:  aws.String(ec2.MarketTypeSpot),
+			SpotOptions: spotOptions,
+		}
+	}
+
+	var keyName *string
+	if sshPublicKey := host.Additional["ssh-public-key"]; sshPublicKey != "" {
+		imported, err := p.importKeyPair(ctx, host.Name, sshPublicKey)
+		if err != nil {
+			p.rollbackProvision(ctx, securityGroupID, nil)
+			return nil, err
+		}
+		keyName = imported
+	}
+
+	runResult, err := p.client.RunInstancesWithContext(ctx, &ec2.RunInstancesInput{
+		ImageId:               aws.String(ami.ID),
+		InstanceType:          aws.String(plan),
+		MinCount:              aws.Int64(1),
+		MaxCount:              aws.Int64(1),
+		UserData:              aws.String(base64.StdEncoding.EncodeToString([]byte(host.UserData))),
+		SecurityGroupIds:      []*string{aws.String(securityGroupID)},
+		KeyName:               keyName,
+		InstanceMarketOptions: marketOptions,
 		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
 			{
-				DeviceName: aws.String("/dev/sdh"),
+				DeviceName: aws.String(ami.RootDeviceName),
 				Ebs: &ec2.EbsBlockDevice{
-					VolumeSize: aws.Int64(20),
+					VolumeSize: aws.Int64(rootVolumeSize),
+					VolumeType: aws.String(rootVolumeType),
+					// Cleanup is tag-based (see deleteTaggedVolumes), the same
+					// way the security group and key pair are tracked, rather
+					// than relying on the AMI's own DeleteOnTermination
+					// default.
+					DeleteOnTermination: aws.Bool(false),
 				},
 			},
 		},
@@ -88,21 +232,50 @@ func (p *AWSProvisioner) Provision(host BasicHost) (*ProvisionedHost, error) {
 						Key:   aws.String("name"),
 						Value: aws.String(host.Name),
 					},
+					{
+						Key:   aws.String(hostTagKey),
+						Value: aws.String(host.Name),
+					},
+				},
+			},
+			{
+				ResourceType: aws.String("volume"),
+				Tags: []*ec2.Tag{
+					{
+						Key:   aws.String(hostTagKey),
+						Value: aws.String(host.Name),
+					},
 				},
 			},
 		},
 	})
 
 	if err != nil {
+		p.rollbackProvision(ctx, securityGroupID, keyName)
 		return nil, err
 	}
 
-	return reservationToPrivionedHost(runResult), nil
+	instanceID := runResult.Instances[0].InstanceId
+
+	if err := p.client.WaitUntilInstanceRunningWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{instanceID},
+	}); err != nil {
+		p.rollbackProvisionedInstance(ctx, *instanceID, securityGroupID, keyName)
+		return nil, err
+	}
+
+	return p.StatusWithContext(ctx, *instanceID)
 }
 
 // Status returns the status of the aws instance
 func (p *AWSProvisioner) Status(id string) (*ProvisionedHost, error) {
-	describeResult, err := p.client.DescribeInstances(&ec2.DescribeInstancesInput{
+	return p.StatusWithContext(context.Background(), id)
+}
+
+// StatusWithContext is like Status but lets callers propagate cancellation
+// and deadlines through to the underlying AWS SDK calls.
+func (p *AWSProvisioner) StatusWithContext(ctx context.Context, id string) (*ProvisionedHost, error) {
+	describeResult, err := p.client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{
 			aws.String(id),
 		},
@@ -116,16 +289,158 @@ func (p *AWSProvisioner) Status(id string) (*ProvisionedHost, error) {
 	return reservationToPrivionedHost(result), nil
 }
 
-// Delete deletes the provisionned instance by ID
+// Delete deletes the provisionned instance by ID, along with the security
+// group and root EBS volume that were created for it, so that nothing is
+// left orphaned behind. The root volume is tagged and cleaned up explicitly
+// rather than relying on the AMI's own DeleteOnTermination default, since
+// Provision always launches with DeleteOnTermination set to false.
 func (p *AWSProvisioner) Delete(id string) error {
-	_, err := p.client.TerminateInstances(&ec2.TerminateInstancesInput{
+	return p.DeleteWithContext(context.Background(), id)
+}
+
+// DeleteWithContext is like Delete but lets callers propagate cancellation
+// and deadlines through to the underlying AWS SDK calls.
+func (p *AWSProvisioner) DeleteWithContext(ctx context.Context, id string) error {
+	describeResult, err := p.client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{aws.String(id)},
 	})
+	if err != nil {
+		return err
+	}
+	if len(describeResult.Reservations) == 0 || len(describeResult.Reservations[0].Instances) == 0 {
+		return fmt.Errorf("no instance found with id %q", id)
+	}
+	instance := describeResult.Reservations[0].Instances[0]
+
+	var hostname string
+	for _, tag := range instance.Tags {
+		if *tag.Key == hostTagKey {
+			hostname = *tag.Value
+			break
+		}
+	}
+
+	if _, err := p.client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	}); err != nil {
+		return err
+	}
+
+	if err := p.client.WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	}); err != nil {
+		return err
+	}
+
+	if hostname != "" {
+		securityGroupIDs, err := p.findTaggedSecurityGroups(ctx, hostname)
+		if err != nil {
+			return err
+		}
+
+		for _, groupID := range securityGroupIDs {
+			if err := p.deleteSecurityGroup(ctx, groupID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if instance.KeyName != nil {
+		if _, err := p.client.DeleteKeyPairWithContext(ctx, &ec2.DeleteKeyPairInput{
+			KeyName: instance.KeyName,
+		}); err != nil {
+			return err
+		}
+	}
+
+	if hostname == "" {
+		return nil
+	}
+
+	return p.deleteTaggedVolumes(ctx, hostname)
+}
+
+// findTaggedSecurityGroups returns the IDs of the security groups tagged
+// with hostTagKey=hostname, i.e. the ones created for this host in
+// createSecurityGroup. This is used instead of the instance's attached
+// security groups so that lookup stays unambiguous even if the instance is
+// later attached to other security groups.
+func (p *AWSProvisioner) findTaggedSecurityGroups(ctx context.Context, hostname string) ([]*string, error) {
+	describeResult, err := p.client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", hostTagKey)),
+				Values: []*string{aws.String(hostname)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groupIDs := make([]*string, 0, len(describeResult.SecurityGroups))
+	for _, group := range describeResult.SecurityGroups {
+		groupIDs = append(groupIDs, group.GroupId)
+	}
+
+	return groupIDs, nil
+}
+
+func (p *AWSProvisioner) deleteSecurityGroup(ctx context.Context, groupID *string) error {
+	describeResult, err := p.client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []*string{groupID},
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(describeResult.SecurityGroups) == 0 {
+		return nil
+	}
 
+	group := describeResult.SecurityGroups[0]
+	if len(group.IpPermissions) > 0 {
+		if _, err := p.client.RevokeSecurityGroupIngressWithContext(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       groupID,
+			IpPermissions: group.IpPermissions,
+		}); err != nil {
+			return err
+		}
+	}
+
+	_, err = p.client.DeleteSecurityGroupWithContext(ctx, &ec2.DeleteSecurityGroupInput{
+		GroupId: groupID,
+	})
 	return err
 }
 
-func (p *AWSProvisioner) findAMI(name string) (string, error) {
+func (p *AWSProvisioner) deleteTaggedVolumes(ctx context.Context, hostname string) error {
+	describeResult, err := p.client.DescribeVolumesWithContext(ctx, &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String(fmt.Sprintf("tag:%s", hostTagKey)),
+				Values: []*string{aws.String(hostname)},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, volume := range describeResult.Volumes {
+		if volume.State != nil && *volume.State == ec2.VolumeStateAvailable {
+			if _, err := p.client.DeleteVolumeWithContext(ctx, &ec2.DeleteVolumeInput{
+				VolumeId: volume.VolumeId,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *AWSProvisioner) findAMI(ctx context.Context, name, architecture string) (ami, error) {
 	input := &ec2.DescribeImagesInput{
 		Filters: []*ec2.Filter{
 			&ec2.Filter{
@@ -138,7 +453,7 @@ func (p *AWSProvisioner) findAMI(name string) (string, error) {
 			},
 			&ec2.Filter{
 				Name:   aws.String("architecture"),
-				Values: []*string{aws.String("x86_64")},
+				Values: []*string{aws.String(architecture)},
 			},
 			&ec2.Filter{
 				Name:   aws.String("state"),
@@ -147,33 +462,52 @@ func (p *AWSProvisioner) findAMI(name string) (string, error) {
 		},
 	}
 
-	describeResult, err := p.client.DescribeImages(input)
+	describeResult, err := p.client.DescribeImagesWithContext(ctx, input)
 	if err != nil {
-		return "", err
+		return ami{}, err
 	}
 
 	images := []ami{}
 	for _, image := range describeResult.Images {
 		parsed, err := time.Parse(time.RFC3339, *image.CreationDate)
 		if err != nil {
-			break
+			continue
+		}
+
+		var rootVolumeSize int64
+		for _, mapping := range image.BlockDeviceMappings {
+			if mapping.DeviceName != nil && image.RootDeviceName != nil && *mapping.DeviceName == *image.RootDeviceName && mapping.Ebs != nil && mapping.Ebs.VolumeSize != nil {
+				rootVolumeSize = *mapping.Ebs.VolumeSize
+			}
 		}
+
+		var rootDeviceName string
+		if image.RootDeviceName != nil {
+			rootDeviceName = *image.RootDeviceName
+		}
+
 		images = append(images, ami{
-			ID:           *image.ImageId,
-			CreationDate: parsed,
+			ID:             *image.ImageId,
+			RootDeviceName: rootDeviceName,
+			RootVolumeSize: rootVolumeSize,
+			CreationDate:   parsed,
 		})
 	}
 
+	if len(images) == 0 {
+		return ami{}, fmt.Errorf("no ami found for name %q and architecture %q", name, architecture)
+	}
+
 	// Ensure we choose the lastest ami:
 	sort.Slice(images, func(i, j int) bool {
 		return images[i].CreationDate.After(images[j].CreationDate)
 	})
 
-	return images[0].ID, nil
+	return images[0], nil
 }
 
-func (p *AWSProvisioner) getOrCreateDefaultVPC() (string, error) {
-	describeResult, err := p.client.DescribeVpcs(&ec2.DescribeVpcsInput{})
+func (p *AWSProvisioner) getOrCreateDefaultVPC(ctx context.Context) (string, error) {
+	describeResult, err := p.client.DescribeVpcsWithContext(ctx, &ec2.DescribeVpcsInput{})
 	if err != nil {
 		return "", err
 	}
@@ -185,7 +519,7 @@ func (p *AWSProvisioner) getOrCreateDefaultVPC() (string, error) {
 	}
 
 	// If the default VPC doesn't exists, create it:
-	createResult, err := p.client.CreateDefaultVpc(&ec2.CreateDefaultVpcInput{})
+	createResult, err := p.client.CreateDefaultVpcWithContext(ctx, &ec2.CreateDefaultVpcInput{})
 	if err != nil {
 		return "", err
 	}
@@ -193,46 +527,153 @@ func (p *AWSProvisioner) getOrCreateDefaultVPC() (string, error) {
 	return *createResult.Vpc.VpcId, nil
 }
 
-func (p *AWSProvisioner) createSecurityGroup(vpcID, hostname string, inletsPort int64) (string, error) {
-	securityGroupResult, err := p.client.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+// importKeyPair imports the given SSH public key material into EC2 under a
+// per-host key name, so it can be attached to the instance and later
+// removed by Delete without relying solely on the userdata-embedded token.
+func (p *AWSProvisioner) importKeyPair(ctx context.Context, hostname, publicKeyMaterial string) (*string, error) {
+	keyName := aws.String(fmt.Sprintf("inlets-key-%v", hostname))
+
+	_, err := p.client.ImportKeyPairWithContext(ctx, &ec2.ImportKeyPairInput{
+		KeyName:           keyName,
+		PublicKeyMaterial: []byte(publicKeyMaterial),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String("key-pair"),
+				Tags: []*ec2.Tag{
+					{
+						Key:   aws.String(hostTagKey),
+						Value: aws.String(hostname),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keyName, nil
+}
+
+// rollbackProvisionedInstance terminates an instance RunInstances created
+// but that never reached the running state (e.g. the caller's ctx deadline
+// firing, a spot interruption, or the waiter giving up), then rolls back its
+// security group and key pair the same way rollbackProvision does for the
+// earlier failure paths. Without this, the instance keeps running and
+// billing with no ID ever surfaced to the caller for a later Delete call.
+func (p *AWSProvisioner) rollbackProvisionedInstance(ctx context.Context, instanceID string, securityGroupID string, keyName *string) {
+	// A ctx that is already done would make every cleanup call below fail at
+	// once, so fall back to a fresh one.
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+
+	if _, err := p.client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	}); err == nil {
+		p.client.WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: []*string{aws.String(instanceID)},
+		})
+	}
+
+	p.rollbackProvision(ctx, securityGroupID, keyName)
+}
+
+// rollbackProvision best-effort deletes the security group and, if one was
+// imported, the key pair created earlier in Provision so that a later
+// failure (e.g. RunInstances rejecting the AMI/instance-type pairing or spot
+// capacity being unavailable) doesn't leave them orphaned with no instance
+// ID for Delete to key off of. Errors are swallowed: the caller already has
+// the original provisioning error to return, and a cleanup failure here
+// shouldn't mask it.
+func (p *AWSProvisioner) rollbackProvision(ctx context.Context, securityGroupID string, keyName *string) {
+	if keyName != nil {
+		p.client.DeleteKeyPairWithContext(ctx, &ec2.DeleteKeyPairInput{
+			KeyName: keyName,
+		})
+	}
+
+	if securityGroupID != "" {
+		p.deleteSecurityGroup(ctx, aws.String(securityGroupID))
+	}
+}
+
+func (p *AWSProvisioner) createSecurityGroup(ctx context.Context, vpcID, hostname string, inletsPort int64, allowCIDRs []string, openHTTP bool) (string, error) {
+	securityGroupResult, err := p.client.CreateSecurityGroupWithContext(ctx, &ec2.CreateSecurityGroupInput{
 		Description: aws.String("Inlets security group"),
 		GroupName:   aws.String(fmt.Sprintf("inlets-sg-%v", hostname)),
 		VpcId:       aws.String(vpcID),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String("security-group"),
+				Tags: []*ec2.Tag{
+					{
+						Key:   aws.String(hostTagKey),
+						Value: aws.String(hostname),
+					},
+				},
+			},
+		},
 	})
 	if err != nil {
 		return "", err
 	}
 
-	_, err = p.client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
-		GroupId: securityGroupResult.GroupId,
-		IpPermissions: []*ec2.IpPermission{
-			(&ec2.IpPermission{}).
-				SetIpProtocol("tcp").
-				SetFromPort(80).
-				SetToPort(80).
-				SetIpRanges([]*ec2.IpRange{
-					{CidrIp: aws.String("0.0.0.0/0")},
-				}),
-			(&ec2.IpPermission{}).
-				SetIpProtocol("tcp").
-				SetFromPort(443).
-				SetToPort(443).
-				SetIpRanges([]*ec2.IpRange{
-					{CidrIp: aws.String("0.0.0.0/0")},
-				}),
-			(&ec2.IpPermission{}).
-				SetIpProtocol("tcp").
-				SetFromPort(inletsPort).
-				SetToPort(inletsPort).
-				SetIpRanges([]*ec2.IpRange{
-					(&ec2.IpRange{}).
-						SetCidrIp("0.0.0.0/0"),
-				}),
-		},
+	_, err = p.client.AuthorizeSecurityGroupIngressWithContext(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       securityGroupResult.GroupId,
+		IpPermissions: buildIngressPermissions(inletsPort, allowCIDRs, openHTTP),
 	})
 	return *securityGroupResult.GroupId, err
 }
 
+// buildIngressPermissions builds the ingress rules for the inlets security
+// group: the inlets control port plus, when openHTTP is set, ports 80/443,
+// each scoped to allowCIDRs.
+func buildIngressPermissions(inletsPort int64, allowCIDRs []string, openHTTP bool) []*ec2.IpPermission {
+	ipRanges, ipv6Ranges := splitCIDRs(allowCIDRs)
+
+	ipPermissions := []*ec2.IpPermission{}
+	if openHTTP {
+		ipPermissions = append(ipPermissions,
+			ingressPermission(80, ipRanges, ipv6Ranges),
+			ingressPermission(443, ipRanges, ipv6Ranges),
+		)
+	}
+	ipPermissions = append(ipPermissions, ingressPermission(inletsPort, ipRanges, ipv6Ranges))
+
+	return ipPermissions
+}
+
+// splitCIDRs separates a list of CIDRs into their IPv4 and IPv6 ranges so
+// they can be attached to the right field of an ec2.IpPermission.
+func splitCIDRs(cidrs []string) ([]*ec2.IpRange, []*ec2.Ipv6Range) {
+	ipRanges := []*ec2.IpRange{}
+	ipv6Ranges := []*ec2.Ipv6Range{}
+
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if strings.Contains(cidr, ":") {
+			ipv6Ranges = append(ipv6Ranges, &ec2.Ipv6Range{CidrIpv6: aws.String(cidr)})
+		} else {
+			ipRanges = append(ipRanges, &ec2.IpRange{CidrIp: aws.String(cidr)})
+		}
+	}
+
+	return ipRanges, ipv6Ranges
+}
+
+func ingressPermission(port int64, ipRanges []*ec2.IpRange, ipv6Ranges []*ec2.Ipv6Range) *ec2.IpPermission {
+	return (&ec2.IpPermission{}).
+		SetIpProtocol("tcp").
+		SetFromPort(port).
+		SetToPort(port).
+		SetIpRanges(ipRanges).
+		SetIpv6Ranges(ipv6Ranges)
+}
+
 func reservationToPrivionedHost(reservation *ec2.Reservation) *ProvisionedHost {
 	instance := reservation.Instances[0]
 
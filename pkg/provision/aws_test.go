@@ -0,0 +1,713 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// mockEC2 is a minimal ec2iface.EC2API fake: tests set only the function
+// fields they exercise, everything else panics via the embedded nil
+// interface if called unexpectedly.
+type mockEC2 struct {
+	ec2iface.EC2API
+
+	describeInstances             func(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	terminateInstances            func(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+	waitUntilInstanceTerminated   func(*ec2.DescribeInstancesInput) error
+	describeSecurityGroups        func(*ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error)
+	revokeSecurityGroupIngress    func(*ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error)
+	deleteSecurityGroup           func(*ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error)
+	deleteKeyPair                 func(*ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error)
+	describeVolumes               func(*ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error)
+	deleteVolume                  func(*ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error)
+	describeImages                func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error)
+	describeVpcs                  func(*ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error)
+	createSecurityGroup           func(*ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error)
+	authorizeSecurityGroupIngress func(*ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	importKeyPair                 func(*ec2.ImportKeyPairInput) (*ec2.ImportKeyPairOutput, error)
+	runInstances                  func(*ec2.RunInstancesInput) (*ec2.Reservation, error)
+	waitUntilInstanceRunning      func(*ec2.DescribeInstancesInput) error
+}
+
+func (m *mockEC2) DescribeInstancesWithContext(_ aws.Context, in *ec2.DescribeInstancesInput, _ ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	return m.describeInstances(in)
+}
+
+func (m *mockEC2) TerminateInstancesWithContext(_ aws.Context, in *ec2.TerminateInstancesInput, _ ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	return m.terminateInstances(in)
+}
+
+func (m *mockEC2) WaitUntilInstanceTerminatedWithContext(_ aws.Context, in *ec2.DescribeInstancesInput, _ ...request.WaiterOption) error {
+	return m.waitUntilInstanceTerminated(in)
+}
+
+func (m *mockEC2) DescribeSecurityGroupsWithContext(_ aws.Context, in *ec2.DescribeSecurityGroupsInput, _ ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	return m.describeSecurityGroups(in)
+}
+
+func (m *mockEC2) RevokeSecurityGroupIngressWithContext(_ aws.Context, in *ec2.RevokeSecurityGroupIngressInput, _ ...request.Option) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	return m.revokeSecurityGroupIngress(in)
+}
+
+func (m *mockEC2) DeleteSecurityGroupWithContext(_ aws.Context, in *ec2.DeleteSecurityGroupInput, _ ...request.Option) (*ec2.DeleteSecurityGroupOutput, error) {
+	return m.deleteSecurityGroup(in)
+}
+
+func (m *mockEC2) DeleteKeyPairWithContext(_ aws.Context, in *ec2.DeleteKeyPairInput, _ ...request.Option) (*ec2.DeleteKeyPairOutput, error) {
+	return m.deleteKeyPair(in)
+}
+
+func (m *mockEC2) DescribeVolumesWithContext(_ aws.Context, in *ec2.DescribeVolumesInput, _ ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	return m.describeVolumes(in)
+}
+
+func (m *mockEC2) DeleteVolumeWithContext(_ aws.Context, in *ec2.DeleteVolumeInput, _ ...request.Option) (*ec2.DeleteVolumeOutput, error) {
+	return m.deleteVolume(in)
+}
+
+func (m *mockEC2) DescribeImagesWithContext(_ aws.Context, in *ec2.DescribeImagesInput, _ ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	return m.describeImages(in)
+}
+
+func (m *mockEC2) DescribeVpcsWithContext(_ aws.Context, in *ec2.DescribeVpcsInput, _ ...request.Option) (*ec2.DescribeVpcsOutput, error) {
+	return m.describeVpcs(in)
+}
+
+func (m *mockEC2) CreateSecurityGroupWithContext(_ aws.Context, in *ec2.CreateSecurityGroupInput, _ ...request.Option) (*ec2.CreateSecurityGroupOutput, error) {
+	return m.createSecurityGroup(in)
+}
+
+func (m *mockEC2) AuthorizeSecurityGroupIngressWithContext(_ aws.Context, in *ec2.AuthorizeSecurityGroupIngressInput, _ ...request.Option) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	return m.authorizeSecurityGroupIngress(in)
+}
+
+func (m *mockEC2) ImportKeyPairWithContext(_ aws.Context, in *ec2.ImportKeyPairInput, _ ...request.Option) (*ec2.ImportKeyPairOutput, error) {
+	return m.importKeyPair(in)
+}
+
+func (m *mockEC2) RunInstancesWithContext(_ aws.Context, in *ec2.RunInstancesInput, _ ...request.Option) (*ec2.Reservation, error) {
+	return m.runInstances(in)
+}
+
+func (m *mockEC2) WaitUntilInstanceRunningWithContext(_ aws.Context, in *ec2.DescribeInstancesInput, _ ...request.WaiterOption) error {
+	return m.waitUntilInstanceRunning(in)
+}
+
+func Test_DeleteWithContext(t *testing.T) {
+	taggedInstance := &ec2.Instance{
+		InstanceId: aws.String("i-123"),
+		KeyName:    aws.String("inlets-key-myhost"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String(hostTagKey), Value: aws.String("myhost")},
+		},
+	}
+
+	t.Run("cleans up security group, volumes and key pair for a tagged instance", func(t *testing.T) {
+		var revoked, sgDeleted, volDeleted, keyDeleted bool
+
+		client := &mockEC2{
+			describeInstances: func(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+				return &ec2.DescribeInstancesOutput{
+					Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{taggedInstance}}},
+				}, nil
+			},
+			terminateInstances: func(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+				return &ec2.TerminateInstancesOutput{}, nil
+			},
+			waitUntilInstanceTerminated: func(*ec2.DescribeInstancesInput) error { return nil },
+			describeSecurityGroups: func(in *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+				if in.GroupIds != nil {
+					return &ec2.DescribeSecurityGroupsOutput{
+						SecurityGroups: []*ec2.SecurityGroup{
+							{
+								GroupId:       in.GroupIds[0],
+								IpPermissions: []*ec2.IpPermission{{}},
+							},
+						},
+					}, nil
+				}
+				return &ec2.DescribeSecurityGroupsOutput{
+					SecurityGroups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-123")}},
+				}, nil
+			},
+			revokeSecurityGroupIngress: func(*ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+				revoked = true
+				return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+			},
+			deleteSecurityGroup: func(*ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+				sgDeleted = true
+				return &ec2.DeleteSecurityGroupOutput{}, nil
+			},
+			deleteKeyPair: func(*ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+				keyDeleted = true
+				return &ec2.DeleteKeyPairOutput{}, nil
+			},
+			describeVolumes: func(*ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+				return &ec2.DescribeVolumesOutput{
+					Volumes: []*ec2.Volume{
+						{VolumeId: aws.String("vol-123"), State: aws.String(ec2.VolumeStateAvailable)},
+						{VolumeId: aws.String("vol-456"), State: aws.String(ec2.VolumeStateInUse)},
+					},
+				}, nil
+			},
+			deleteVolume: func(*ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error) {
+				volDeleted = true
+				return &ec2.DeleteVolumeOutput{}, nil
+			},
+		}
+
+		p := &AWSProvisioner{client: client}
+		if err := p.DeleteWithContext(context.Background(), "i-123"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !revoked || !sgDeleted {
+			t.Error("expected the tagged security group to be revoked and deleted")
+		}
+		if !volDeleted {
+			t.Error("expected the available tagged volume to be deleted")
+		}
+		if !keyDeleted {
+			t.Error("expected the instance's key pair to be deleted")
+		}
+	})
+
+	t.Run("skips security group and volume cleanup when the instance has no host tag", func(t *testing.T) {
+		untaggedInstance := &ec2.Instance{InstanceId: aws.String("i-456")}
+
+		client := &mockEC2{
+			describeInstances: func(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+				return &ec2.DescribeInstancesOutput{
+					Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{untaggedInstance}}},
+				}, nil
+			},
+			terminateInstances: func(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+				return &ec2.TerminateInstancesOutput{}, nil
+			},
+			waitUntilInstanceTerminated: func(*ec2.DescribeInstancesInput) error { return nil },
+		}
+
+		p := &AWSProvisioner{client: client}
+		if err := p.DeleteWithContext(context.Background(), "i-456"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("returns an error when the instance doesn't exist", func(t *testing.T) {
+		client := &mockEC2{
+			describeInstances: func(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+				return &ec2.DescribeInstancesOutput{}, nil
+			},
+		}
+
+		p := &AWSProvisioner{client: client}
+		if err := p.DeleteWithContext(context.Background(), "i-999"); err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+	})
+}
+
+func Test_findAMI(t *testing.T) {
+	t.Run("selects the most recently created image", func(t *testing.T) {
+		client := &mockEC2{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return &ec2.DescribeImagesOutput{
+					Images: []*ec2.Image{
+						{
+							ImageId:        aws.String("ami-old"),
+							RootDeviceName: aws.String("/dev/xvda"),
+							CreationDate:   aws.String("2020-01-01T00:00:00.000Z"),
+						},
+						{
+							ImageId:        aws.String("ami-new"),
+							RootDeviceName: aws.String("/dev/xvda"),
+							CreationDate:   aws.String("2023-06-15T00:00:00.000Z"),
+						},
+					},
+				}, nil
+			},
+		}
+
+		p := &AWSProvisioner{client: client}
+		got, err := p.findAMI(context.Background(), "ubuntu-20.04", "x86_64")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.ID != "ami-new" {
+			t.Errorf("ID = %q, want %q", got.ID, "ami-new")
+		}
+	})
+
+	t.Run("skips one image with a malformed CreationDate instead of discarding the rest", func(t *testing.T) {
+		client := &mockEC2{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return &ec2.DescribeImagesOutput{
+					Images: []*ec2.Image{
+						{
+							ImageId:        aws.String("ami-malformed"),
+							RootDeviceName: aws.String("/dev/xvda"),
+							CreationDate:   aws.String("not-a-date"),
+						},
+						{
+							ImageId:        aws.String("ami-valid"),
+							RootDeviceName: aws.String("/dev/xvda"),
+							CreationDate:   aws.String("2023-06-15T00:00:00.000Z"),
+						},
+					},
+				}, nil
+			},
+		}
+
+		p := &AWSProvisioner{client: client}
+		got, err := p.findAMI(context.Background(), "ubuntu-20.04", "x86_64")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.ID != "ami-valid" {
+			t.Errorf("ID = %q, want %q", got.ID, "ami-valid")
+		}
+	})
+
+	t.Run("treats a nil RootDeviceName as empty instead of panicking", func(t *testing.T) {
+		client := &mockEC2{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return &ec2.DescribeImagesOutput{
+					Images: []*ec2.Image{
+						{
+							ImageId:      aws.String("ami-no-root"),
+							CreationDate: aws.String("2023-06-15T00:00:00.000Z"),
+						},
+					},
+				}, nil
+			},
+		}
+
+		p := &AWSProvisioner{client: client}
+		got, err := p.findAMI(context.Background(), "ubuntu-20.04", "x86_64")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got.RootDeviceName != "" {
+			t.Errorf("RootDeviceName = %q, want empty", got.RootDeviceName)
+		}
+	})
+
+	t.Run("returns an error instead of panicking when no AMI matches", func(t *testing.T) {
+		client := &mockEC2{
+			describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+				return &ec2.DescribeImagesOutput{}, nil
+			},
+		}
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.findAMI(context.Background(), "ubuntu-20.04", "x86_64"); err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+	})
+}
+
+func Test_importKeyPair(t *testing.T) {
+	var gotInput *ec2.ImportKeyPairInput
+	client := &mockEC2{
+		importKeyPair: func(in *ec2.ImportKeyPairInput) (*ec2.ImportKeyPairOutput, error) {
+			gotInput = in
+			return &ec2.ImportKeyPairOutput{}, nil
+		},
+	}
+
+	p := &AWSProvisioner{client: client}
+	keyName, err := p.importKeyPair(context.Background(), "myhost", "ssh-rsa AAAA...")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keyName == nil || *keyName != "inlets-key-myhost" {
+		t.Errorf("keyName = %v, want %q", keyName, "inlets-key-myhost")
+	}
+	if gotInput == nil || *gotInput.KeyName != "inlets-key-myhost" {
+		t.Errorf("ImportKeyPairInput.KeyName = %v, want %q", gotInput.KeyName, "inlets-key-myhost")
+	}
+	if string(gotInput.PublicKeyMaterial) != "ssh-rsa AAAA..." {
+		t.Errorf("PublicKeyMaterial = %q, want %q", gotInput.PublicKeyMaterial, "ssh-rsa AAAA...")
+	}
+}
+
+// provisionMock builds a mockEC2 that satisfies a full, successful
+// ProvisionWithContext call, so each sub-test only needs to override the
+// fields relevant to what it checks.
+func provisionMock(runInstances func(*ec2.RunInstancesInput) (*ec2.Reservation, error)) *mockEC2 {
+	return &mockEC2{
+		describeImages: func(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+			return &ec2.DescribeImagesOutput{
+				Images: []*ec2.Image{
+					{
+						ImageId:        aws.String("ami-123"),
+						RootDeviceName: aws.String("/dev/xvda"),
+						CreationDate:   aws.String("2023-06-15T00:00:00.000Z"),
+					},
+				},
+			}, nil
+		},
+		describeVpcs: func(*ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+			return &ec2.DescribeVpcsOutput{
+				Vpcs: []*ec2.Vpc{{VpcId: aws.String("vpc-123"), IsDefault: aws.Bool(true)}},
+			}, nil
+		},
+		createSecurityGroup: func(*ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error) {
+			return &ec2.CreateSecurityGroupOutput{GroupId: aws.String("sg-123")}, nil
+		},
+		authorizeSecurityGroupIngress: func(*ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+			return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+		},
+		importKeyPair: func(*ec2.ImportKeyPairInput) (*ec2.ImportKeyPairOutput, error) {
+			return &ec2.ImportKeyPairOutput{}, nil
+		},
+		runInstances: runInstances,
+		waitUntilInstanceRunning: func(*ec2.DescribeInstancesInput) error {
+			return nil
+		},
+		describeInstances: func(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+			return &ec2.DescribeInstancesOutput{
+				Reservations: []*ec2.Reservation{{
+					Instances: []*ec2.Instance{{
+						InstanceId:      aws.String("i-123"),
+						PublicIpAddress: aws.String("203.0.113.1"),
+						State:           &ec2.InstanceState{Name: aws.String("running")},
+					}},
+				}},
+			}, nil
+		},
+	}
+}
+
+func Test_ProvisionWithContext(t *testing.T) {
+	baseHost := BasicHost{
+		OS:   "ubuntu-20.04",
+		Name: "myhost",
+		Additional: map[string]string{
+			"inlets-port": "8080",
+		},
+	}
+
+	t.Run("builds the root volume with DeleteOnTermination false, per the tag-based cleanup in Delete", func(t *testing.T) {
+		var gotInput *ec2.RunInstancesInput
+		client := provisionMock(func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			gotInput = in
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), baseHost); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		mapping := gotInput.BlockDeviceMappings[0]
+		if mapping.Ebs.DeleteOnTermination == nil || *mapping.Ebs.DeleteOnTermination {
+			t.Error("expected the root volume's DeleteOnTermination to be false")
+		}
+	})
+
+	t.Run("defaults the instance type per requested architecture when host.Plan is unset", func(t *testing.T) {
+		var gotInput *ec2.RunInstancesInput
+		client := provisionMock(func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			gotInput = in
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+
+		host := baseHost
+		host.Additional = map[string]string{"inlets-port": "8080", "architecture": "arm64"}
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), host); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if *gotInput.InstanceType != "t4g.micro" {
+			t.Errorf("InstanceType = %q, want %q", *gotInput.InstanceType, "t4g.micro")
+		}
+	})
+
+	t.Run("attaches InstanceMarketOptions only when spot is requested", func(t *testing.T) {
+		var gotInput *ec2.RunInstancesInput
+		client := provisionMock(func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			gotInput = in
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+
+		host := baseHost
+		host.Additional = map[string]string{"inlets-port": "8080", "spot": "true", "max-spot-price": "0.01"}
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), host); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if gotInput.InstanceMarketOptions == nil || gotInput.InstanceMarketOptions.SpotOptions == nil {
+			t.Fatal("expected InstanceMarketOptions to be set")
+		}
+		if *gotInput.InstanceMarketOptions.SpotOptions.MaxPrice != "0.01" {
+			t.Errorf("MaxPrice = %v, want %q", gotInput.InstanceMarketOptions.SpotOptions.MaxPrice, "0.01")
+		}
+
+		client = provisionMock(func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			gotInput = in
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+		p = &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), baseHost); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if gotInput.InstanceMarketOptions != nil {
+			t.Error("expected InstanceMarketOptions to be nil when spot isn't requested")
+		}
+	})
+
+	t.Run("wires the imported key pair's name into RunInstancesInput", func(t *testing.T) {
+		var gotInput *ec2.RunInstancesInput
+		client := provisionMock(func(in *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			gotInput = in
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+
+		host := baseHost
+		host.Additional = map[string]string{"inlets-port": "8080", "ssh-public-key": "ssh-rsa AAAA..."}
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), host); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if gotInput.KeyName == nil || *gotInput.KeyName != "inlets-key-myhost" {
+			t.Errorf("KeyName = %v, want %q", gotInput.KeyName, "inlets-key-myhost")
+		}
+	})
+
+	t.Run("rolls back the security group and key pair when RunInstances fails", func(t *testing.T) {
+		var sgDeleted, keyDeleted bool
+
+		client := provisionMock(func(*ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			return nil, fmt.Errorf("InsufficientInstanceCapacity")
+		})
+		client.deleteKeyPair = func(*ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+			keyDeleted = true
+			return &ec2.DeleteKeyPairOutput{}, nil
+		}
+		client.describeSecurityGroups = func(*ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+			return &ec2.DescribeSecurityGroupsOutput{
+				SecurityGroups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-123")}},
+			}, nil
+		}
+		client.deleteSecurityGroup = func(*ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+			sgDeleted = true
+			return &ec2.DeleteSecurityGroupOutput{}, nil
+		}
+
+		host := baseHost
+		host.Additional = map[string]string{"inlets-port": "8080", "ssh-public-key": "ssh-rsa AAAA..."}
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), host); err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+
+		if !keyDeleted {
+			t.Error("expected the imported key pair to be rolled back")
+		}
+		if !sgDeleted {
+			t.Error("expected the security group to be rolled back")
+		}
+	})
+
+	t.Run("returns the public IP from the waiter+re-describe flow", func(t *testing.T) {
+		client := provisionMock(func(*ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+
+		p := &AWSProvisioner{client: client}
+		result, err := p.ProvisionWithContext(context.Background(), baseHost)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if result.IP != "203.0.113.1" {
+			t.Errorf("IP = %q, want %q", result.IP, "203.0.113.1")
+		}
+	})
+
+	t.Run("terminates the instance and rolls back the security group and key pair when WaitUntilInstanceRunning fails", func(t *testing.T) {
+		var terminated, waitedTerminated, sgDeleted, keyDeleted bool
+
+		client := provisionMock(func(*ec2.RunInstancesInput) (*ec2.Reservation, error) {
+			return &ec2.Reservation{Instances: []*ec2.Instance{{InstanceId: aws.String("i-123")}}}, nil
+		})
+		client.waitUntilInstanceRunning = func(*ec2.DescribeInstancesInput) error {
+			return fmt.Errorf("context deadline exceeded")
+		}
+		client.terminateInstances = func(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+			terminated = true
+			return &ec2.TerminateInstancesOutput{}, nil
+		}
+		client.waitUntilInstanceTerminated = func(*ec2.DescribeInstancesInput) error {
+			waitedTerminated = true
+			return nil
+		}
+		client.deleteKeyPair = func(*ec2.DeleteKeyPairInput) (*ec2.DeleteKeyPairOutput, error) {
+			keyDeleted = true
+			return &ec2.DeleteKeyPairOutput{}, nil
+		}
+		client.describeSecurityGroups = func(*ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+			return &ec2.DescribeSecurityGroupsOutput{
+				SecurityGroups: []*ec2.SecurityGroup{{GroupId: aws.String("sg-123")}},
+			}, nil
+		}
+		client.deleteSecurityGroup = func(*ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+			sgDeleted = true
+			return &ec2.DeleteSecurityGroupOutput{}, nil
+		}
+
+		host := baseHost
+		host.Additional = map[string]string{"inlets-port": "8080", "ssh-public-key": "ssh-rsa AAAA..."}
+
+		p := &AWSProvisioner{client: client}
+		if _, err := p.ProvisionWithContext(context.Background(), host); err == nil {
+			t.Fatal("expected an error, got nil")
+		}
+
+		if !terminated || !waitedTerminated {
+			t.Error("expected the instance to be terminated and waited on")
+		}
+		if !keyDeleted {
+			t.Error("expected the imported key pair to be rolled back")
+		}
+		if !sgDeleted {
+			t.Error("expected the security group to be rolled back")
+		}
+	})
+}
+
+func Test_NewAWSProvisioner(t *testing.T) {
+	p, err := NewAWSProvisioner("access-key", "secret-key", "eu-west-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.client == nil {
+		t.Fatal("client was not set")
+	}
+}
+
+func Test_NewAWSProvisionerWithSessionToken(t *testing.T) {
+	p, err := NewAWSProvisionerWithSessionToken("access-key", "secret-key", "session-token", "eu-west-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.client == nil {
+		t.Fatal("client was not set")
+	}
+}
+
+func Test_NewAWSProvisionerFromChain(t *testing.T) {
+	p, err := NewAWSProvisionerFromChain("eu-west-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.client == nil {
+		t.Fatal("client was not set")
+	}
+}
+
+func Test_splitCIDRs(t *testing.T) {
+	cases := []struct {
+		name     string
+		cidrs    []string
+		wantIPv4 []*ec2.IpRange
+		wantIPv6 []*ec2.Ipv6Range
+	}{
+		{
+			name:     "single ipv4",
+			cidrs:    []string{"10.0.0.0/24"},
+			wantIPv4: []*ec2.IpRange{{CidrIp: aws.String("10.0.0.0/24")}},
+			wantIPv6: []*ec2.Ipv6Range{},
+		},
+		{
+			name:     "single ipv6",
+			cidrs:    []string{"2001:db8::/32"},
+			wantIPv4: []*ec2.IpRange{},
+			wantIPv6: []*ec2.Ipv6Range{{CidrIpv6: aws.String("2001:db8::/32")}},
+		},
+		{
+			name:     "mixed v4 and v6",
+			cidrs:    []string{"10.0.0.0/24", "2001:db8::/32"},
+			wantIPv4: []*ec2.IpRange{{CidrIp: aws.String("10.0.0.0/24")}},
+			wantIPv6: []*ec2.Ipv6Range{{CidrIpv6: aws.String("2001:db8::/32")}},
+		},
+		{
+			name:     "blank and whitespace-only entries are skipped",
+			cidrs:    []string{"10.0.0.0/24", "", "  ", " 2001:db8::/32 "},
+			wantIPv4: []*ec2.IpRange{{CidrIp: aws.String("10.0.0.0/24")}},
+			wantIPv6: []*ec2.Ipv6Range{{CidrIpv6: aws.String("2001:db8::/32")}},
+		},
+		{
+			name:     "no entries",
+			cidrs:    []string{},
+			wantIPv4: []*ec2.IpRange{},
+			wantIPv6: []*ec2.Ipv6Range{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gotIPv4, gotIPv6 := splitCIDRs(c.cidrs)
+
+			if !reflect.DeepEqual(gotIPv4, c.wantIPv4) {
+				t.Errorf("ipv4 ranges = %+v, want %+v", gotIPv4, c.wantIPv4)
+			}
+			if !reflect.DeepEqual(gotIPv6, c.wantIPv6) {
+				t.Errorf("ipv6 ranges = %+v, want %+v", gotIPv6, c.wantIPv6)
+			}
+		})
+	}
+}
+
+func Test_buildIngressPermissions(t *testing.T) {
+	cidrs := []string{"203.0.113.0/24"}
+
+	t.Run("open-http true includes 80, 443 and the inlets port", func(t *testing.T) {
+		permissions := buildIngressPermissions(8080, cidrs, true)
+
+		ports := []int64{}
+		for _, permission := range permissions {
+			ports = append(ports, *permission.FromPort)
+		}
+
+		want := []int64{80, 443, 8080}
+		if !reflect.DeepEqual(ports, want) {
+			t.Errorf("ports = %v, want %v", ports, want)
+		}
+	})
+
+	t.Run("open-http false only opens the inlets port", func(t *testing.T) {
+		permissions := buildIngressPermissions(8080, cidrs, false)
+
+		if len(permissions) != 1 {
+			t.Fatalf("got %d permissions, want 1", len(permissions))
+		}
+		if *permissions[0].FromPort != 8080 {
+			t.Errorf("FromPort = %d, want 8080", *permissions[0].FromPort)
+		}
+	})
+
+	t.Run("cidrs are attached to every permission", func(t *testing.T) {
+		permissions := buildIngressPermissions(8080, cidrs, true)
+
+		for _, permission := range permissions {
+			if len(permission.IpRanges) != 1 || *permission.IpRanges[0].CidrIp != "203.0.113.0/24" {
+				t.Errorf("IpRanges = %+v, want [%s]", permission.IpRanges, cidrs[0])
+			}
+		}
+	})
+}